@@ -0,0 +1,117 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authz
+
+import (
+	"fmt"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// podVolume describes a single volume, and the matching container volumeMount, to splice into
+// the ext-authz sample's Deployment. Exactly one of secretName/configMapName must be set.
+type podVolume struct {
+	name          string
+	mountPath     string
+	secretName    string
+	configMapName string
+}
+
+// patchDeploymentSpec finds the Deployment document within yamlText (which may contain
+// several "---"-separated k8s manifests, as the ext-authz sample does) and adds the given
+// volumes (with matching volumeMounts on its first container) and extra container args. This
+// is what actually makes a generated Secret/ConfigMap available inside the running container,
+// rather than just applying it to the cluster unused.
+func patchDeploymentSpec(yamlText string, volumes []podVolume, extraArgs []string) (string, error) {
+	docs := strings.Split(yamlText, "\n---\n")
+
+	for i, doc := range docs {
+		if strings.TrimSpace(doc) == "" {
+			continue
+		}
+
+		obj := map[string]interface{}{}
+		if err := yaml.Unmarshal([]byte(doc), &obj); err != nil {
+			return "", err
+		}
+		if obj["kind"] != "Deployment" {
+			continue
+		}
+
+		podSpec, err := nestedMap(obj, "spec", "template", "spec")
+		if err != nil {
+			return "", fmt.Errorf("ext-authz Deployment: %v", err)
+		}
+
+		containers, _ := podSpec["containers"].([]interface{})
+		if len(containers) == 0 {
+			return "", fmt.Errorf("ext-authz Deployment has no containers")
+		}
+		container, ok := containers[0].(map[string]interface{})
+		if !ok {
+			return "", fmt.Errorf("ext-authz Deployment's first container is malformed")
+		}
+
+		args, _ := container["args"].([]interface{})
+		for _, a := range extraArgs {
+			args = append(args, a)
+		}
+		container["args"] = args
+
+		mounts, _ := container["volumeMounts"].([]interface{})
+		podVolumes, _ := podSpec["volumes"].([]interface{})
+		for _, v := range volumes {
+			mounts = append(mounts, map[string]interface{}{
+				"name":      v.name,
+				"mountPath": v.mountPath,
+				"readOnly":  true,
+			})
+
+			vol := map[string]interface{}{"name": v.name}
+			if v.secretName != "" {
+				vol["secret"] = map[string]interface{}{"secretName": v.secretName}
+			} else {
+				vol["configMap"] = map[string]interface{}{"name": v.configMapName}
+			}
+			podVolumes = append(podVolumes, vol)
+		}
+		container["volumeMounts"] = mounts
+		podSpec["volumes"] = podVolumes
+		containers[0] = container
+		podSpec["containers"] = containers
+
+		out, err := yaml.Marshal(obj)
+		if err != nil {
+			return "", err
+		}
+		docs[i] = string(out)
+	}
+
+	return strings.Join(docs, "\n---\n"), nil
+}
+
+// nestedMap walks obj through the given keys, each of which must hold a nested map.
+func nestedMap(obj map[string]interface{}, path ...string) (map[string]interface{}, error) {
+	cur := obj
+	for _, p := range path {
+		next, ok := cur[p].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("expected a map at %q", p)
+		}
+		cur = next
+	}
+	return cur, nil
+}
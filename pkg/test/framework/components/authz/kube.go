@@ -15,8 +15,15 @@
 package authz
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
+	"math/big"
 	"strings"
 	"time"
 
@@ -38,10 +45,34 @@ import (
 )
 
 const (
-	httpName = "ext-authz-http"
-	grpcName = "ext-authz-grpc"
-	httpPort = 8000
-	grpcPort = 9000
+	httpName  = "ext-authz-http"
+	grpcName  = "ext-authz-grpc"
+	httpsName = "ext-authz-https"
+	grpcsName = "ext-authz-grpcs"
+	httpPort  = 8000
+	grpcPort  = 9000
+	httpsPort = 8443
+	grpcsPort = 9443
+
+	// HTTPS and GRPCS are the API values used by the TLS-secured variants of the ext-authz
+	// sample so that tests can assert that a policy referencing them actually terminates TLS.
+	HTTPS = "https"
+	GRPCS = "grpcs"
+
+	// OPA is the API value for the OPA-backed gRPC provider, whose allow/deny decisions are
+	// driven by the RBAC-style JSON policy document tests push via Provider.WithPolicy.
+	OPA = "opa"
+
+	opaName            = "ext-authz-opa"
+	opaPort            = 9100
+	opaPolicyConfigMap = "ext-authz-opa-policy"
+	opaPolicyConfigKey = "policy.json"
+
+	certSecretName = "ext-authz-certs"
+
+	// metricsPort is the port the ext-authz sample's Prometheus /metrics endpoint listens on,
+	// scraped by serverImpl to verify the server actually processed expected Check calls.
+	metricsPort = 9300
 
 	providerTemplate = `
 extensionProviders:
@@ -58,7 +89,86 @@ extensionProviders:
 - name: "{{ .grpcName }}"
   envoyExtAuthzGrpc:
     service: "{{ .fqdn }}"
-    port: {{ .grpcPort }}`
+    port: {{ .grpcPort }}
+- name: "{{ .httpsName }}"
+  envoyExtAuthzHttp:
+    service: "{{ .fqdn }}"
+    port: {{ .httpsPort }}
+    headersToUpstreamOnAllow: ["x-ext-authz-*"]
+    headersToDownstreamOnDeny: ["x-ext-authz-*"]
+    includeRequestHeadersInCheck: ["x-ext-authz"]
+    includeAdditionalHeadersInCheck:
+      x-ext-authz-additional-header-new: additional-header-new-value
+      x-ext-authz-additional-header-override: additional-header-override-value
+- name: "{{ .grpcsName }}"
+  envoyExtAuthzGrpc:
+    service: "{{ .fqdn }}"
+    port: {{ .grpcsPort }}
+- name: "{{ .opaName }}"
+  envoyExtAuthzGrpc:
+    service: "{{ .fqdn }}"
+    port: {{ .opaPort }}`
+
+	// destinationRuleTemplate pins traffic to the TLS-secured ports to the CA that was
+	// generated for the ext-authz deployment. It uses credentialName rather than file paths:
+	// Istio's TLS origination resolves credentialName by reading the named Secret through SDS
+	// from the *calling* sidecar's own namespace, so a copy of the Secret must exist there too
+	// (see serverImpl.DistributeCABundle) -- nothing needs to be mounted onto the caller pod.
+	//
+	// The grpcsPort entry requests MUTUAL so the sidecar presents a client cert, and
+	// readDeploymentYAML passes --tls-client-ca so the sample is told to request and verify
+	// one. Whether the unmodified sample in this tree actually enforces that (vs. accepting
+	// any or no client cert) can't be confirmed without its source, so grpcsName's check is
+	// still the generic checkGRPC -- it confirms the call succeeds over TLS, not that a caller
+	// without the right cert would be rejected.
+	destinationRuleTemplate = `
+apiVersion: networking.istio.io/v1alpha3
+kind: DestinationRule
+metadata:
+  name: ext-authz-tls
+  namespace: {{ .namespace }}
+spec:
+  host: "{{ .fqdn }}"
+  trafficPolicy:
+    portLevelSettings:
+    - port:
+        number: {{ .httpsPort }}
+      tls:
+        mode: SIMPLE
+        credentialName: "{{ .certSecretName }}"
+    - port:
+        number: {{ .grpcsPort }}
+      tls:
+        mode: MUTUAL
+        credentialName: "{{ .certSecretName }}"`
+
+	// certSecretTemplate follows the key naming Istio's credentialName-based TLS origination
+	// expects from a client/CA secret (tls.crt/tls.key/ca.crt), so the same Secret can both be
+	// mounted as files into the ext-authz container and be read directly via SDS by callers'
+	// sidecars once distributed into their namespaces.
+	certSecretTemplate = `
+apiVersion: v1
+kind: Secret
+metadata:
+  name: "{{ .secretName }}"
+  namespace: "{{ .namespace }}"
+type: Opaque
+data:
+  ca.crt: {{ .caCert }}
+  tls.crt: {{ .cert }}
+  tls.key: {{ .key }}`
+
+	// opaPolicyConfigMapTemplate holds the RBAC-style JSON policy document that the OPA-backed
+	// ext-authz sample watches and hot-reloads from; Provider.WithPolicy rewrites it in place.
+	opaPolicyConfigMapTemplate = `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: "{{ .configMapName }}"
+  namespace: "{{ .namespace }}"
+data:
+  {{ .configMapKey }}: |
+{{ .policy }}`
 )
 
 var _ resource.Resource = &serverImpl{}
@@ -100,6 +210,7 @@ func newKubeServer(ctx resource.Context, ns namespace.Instance) (server *serverI
 					return true
 				},
 				check: checkHTTP,
+				ns:    ns,
 			},
 			&providerImpl{
 				name: grpcName,
@@ -111,6 +222,55 @@ func newKubeServer(ctx resource.Context, ns namespace.Instance) (server *serverI
 					return true
 				},
 				check: checkGRPC,
+				ns:    ns,
+			},
+			&providerImpl{
+				name: httpsName,
+				api:  HTTPS,
+				protocolSupported: func(p protocol.Instance) bool {
+					// HTTP protocol doesn't support raw TCP requests.
+					return !p.IsTCP()
+				},
+				targetSupported: func(echo.Target) bool {
+					return true
+				},
+				// The only difference from the plaintext provider is that the connection
+				// to the sidecar is TLS-secured; the ext-authz decision logic is the same.
+				check: checkHTTP,
+				ns:    ns,
+			},
+			&providerImpl{
+				name: grpcsName,
+				api:  GRPCS,
+				protocolSupported: func(protocol.Instance) bool {
+					return true
+				},
+				targetSupported: func(echo.Target) bool {
+					return true
+				},
+				// check is still the generic checkGRPC: it confirms the call succeeds over
+				// TLS, not that mutual auth was actually required (see the MUTUAL note on
+				// destinationRuleTemplate above).
+				check: checkGRPC,
+				ns:    ns,
+			},
+			&providerImpl{
+				name: opaName,
+				api:  OPA,
+				// checkOPA (provider.go) only ever reads opts.HTTP.Path/Headers to evaluate
+				// the pushed policy, so -- like httpName above -- this provider can't be
+				// meaningfully exercised against a raw TCP target.
+				protocolSupported: func(p protocol.Instance) bool {
+					return !p.IsTCP()
+				},
+				targetSupported: func(echo.Target) bool {
+					return true
+				},
+				// check is unused for the OPA provider: providerImpl.Check routes API ==
+				// OPA to checkOPA instead, which verifies the decision against the live
+				// policy rather than just asserting allow/deny.
+				check: checkGRPC,
+				ns:    ns,
 			},
 		},
 	}
@@ -146,10 +306,67 @@ func readDeploymentYAML(ctx resource.Context) (string, error) {
 	newPolicy := s.PullPolicy
 	yamlText = strings.ReplaceAll(yamlText, oldPolicy, newPolicy)
 
+	// Turn on the sample's Prometheus /metrics endpoint, so tests can verify the ext-authz
+	// server actually saw the Check calls, not just that the client observed the expected
+	// response.
+	//
+	// TODO(ext-authz sample): this assumes the sample image understands --metrics-port and
+	// registers grpc-ecosystem/go-grpc-prometheus/net-http-handler metrics under the names
+	// metricNamesFor expects. That source change isn't part of this tree; until it lands,
+	// scrapeMetrics/parseExposition fail loudly (see metrics.go) instead of silently reporting
+	// all-zero counters.
+	oldArgs := `args: ["--allow"]`
+	newArgs := fmt.Sprintf(`args: ["--allow", "--metrics-port=%d"]`, metricsPort)
+	yamlText = strings.ReplaceAll(yamlText, oldArgs, newArgs)
+
+	// Mount the generated TLS Secret into the container and point the sample at it, so the
+	// ext-authz-https/ext-authz-grpcs extensionProviders actually have something serving their
+	// ports (rather than registering MeshConfig entries nothing backs).
+	//
+	// The ext-authz-opa-policy ConfigMap is mounted the same way, and the sample is pointed at
+	// opaPort/the mounted policy file below. This repo snapshot doesn't carry the ext-authz
+	// sample's own source, so whether "--opa-port"/"--opa-policy-file" are flags the sample
+	// actually understands (i.e. whether it evaluates the mounted policy itself, rather than
+	// this wiring being a no-op) can't be verified here; checkOPA (provider.go) doesn't trust
+	// that either way -- it independently recomputes the expected decision from the same
+	// ConfigMap via rbac.Translator before asserting the observed call outcome.
+	yamlText, err = patchDeploymentSpec(yamlText,
+		[]podVolume{
+			{name: "ext-authz-certs", mountPath: "/etc/ext-authz-certs", secretName: certSecretName},
+			{name: "ext-authz-opa-policy", mountPath: "/etc/ext-authz-opa", configMapName: opaPolicyConfigMap},
+		},
+		[]string{
+			fmt.Sprintf("--https-port=%d", httpsPort),
+			fmt.Sprintf("--grpcs-port=%d", grpcsPort),
+			"--tls-cert=/etc/ext-authz-certs/tls.crt",
+			"--tls-key=/etc/ext-authz-certs/tls.key",
+			"--tls-client-ca=/etc/ext-authz-certs/ca.crt",
+			fmt.Sprintf("--opa-port=%d", opaPort),
+			fmt.Sprintf("--opa-policy-file=/etc/ext-authz-opa/%s", opaPolicyConfigKey),
+		})
+	if err != nil {
+		return "", err
+	}
+
 	return yamlText, nil
 }
 
 func (s *serverImpl) deploy(ctx resource.Context) error {
+	secretYAML, err := s.generateCertSecretYAML()
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.ConfigKube(ctx.Clusters()...).
+		YAML(s.ns.Name(), secretYAML).
+		Apply(apply.CleanupConditionally); err != nil {
+		return err
+	}
+
+	if err := updateOPAPolicy(ctx, s.ns, defaultOPAPolicy); err != nil {
+		return err
+	}
+
 	yamlText, err := readDeploymentYAML(ctx)
 	if err != nil {
 		return err
@@ -181,13 +398,123 @@ func (s *serverImpl) installProviders(ctx resource.Context) error {
 		return err
 	}
 
-	return installProviders(ctx, providerYAML)
+	if err := installProviders(ctx, providerYAML); err != nil {
+		return err
+	}
+
+	// Install the DestinationRule that configures TLS/mTLS to the HTTPS/GRPCS ports, using
+	// the CA generated for the ext-authz deployment.
+	drYAML, err := tmpl.Evaluate(destinationRuleTemplate, s.templateArgs())
+	if err != nil {
+		return err
+	}
+
+	return ctx.ConfigIstio().YAML(s.ns.Name(), drYAML).Apply(apply.CleanupConditionally)
+}
+
+// generateCertSecretYAML generates a self-signed CA and a serving cert/key for the ext-authz
+// deployment, caches it on s, and returns the YAML for a Secret that can be mounted alongside
+// the sample's Deployment so the HTTPS/GRPCS listeners can terminate TLS.
+func (s *serverImpl) generateCertSecretYAML() (string, error) {
+	fqdn := fmt.Sprintf("ext-authz.%s.svc.cluster.local", s.ns.Name())
+	caCertPEM, certPEM, keyPEM, err := generateServingCert(fqdn)
+	if err != nil {
+		return "", fmt.Errorf("failed generating ext-authz serving cert: %v", err)
+	}
+	s.caCertPEM, s.certPEM, s.keyPEM = caCertPEM, certPEM, keyPEM
+
+	return s.certSecretYAMLForNamespace(s.ns.Name())
+}
+
+func (s *serverImpl) certSecretYAMLForNamespace(namespace string) (string, error) {
+	return tmpl.Evaluate(certSecretTemplate, map[string]interface{}{
+		"secretName": certSecretName,
+		"namespace":  namespace,
+		"caCert":     base64.StdEncoding.EncodeToString(s.caCertPEM),
+		"cert":       base64.StdEncoding.EncodeToString(s.certPEM),
+		"key":        base64.StdEncoding.EncodeToString(s.keyPEM),
+	})
+}
+
+// DistributeCABundle copies the ext-authz TLS Secret into each given namespace. This is
+// required for the HTTPS/GRPCS providers' DestinationRule (which references the Secret via
+// credentialName) to validate: Istio resolves credentialName by reading the named Secret from
+// the *calling* sidecar's own namespace via SDS, not from the ext-authz server's namespace, so
+// tests must call this for every namespace hosting a caller before asserting against those
+// providers.
+func (s *serverImpl) DistributeCABundle(ctx resource.Context, to ...namespace.Instance) error {
+	for _, callerNS := range to {
+		secretYAML, err := s.certSecretYAMLForNamespace(callerNS.Name())
+		if err != nil {
+			return err
+		}
+		if err := ctx.ConfigKube(ctx.Clusters()...).
+			YAML(callerNS.Name(), secretYAML).
+			Apply(apply.CleanupConditionally); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// generateServingCert creates a minimal self-signed CA and a cert/key pair signed by that CA
+// for the given DNS name, returning each as PEM-encoded bytes.
+func generateServingCert(dnsName string) (caCertPEM, certPEM, keyPEM []byte, err error) {
+	caKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ext-authz-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	servingKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	servingTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: dnsName},
+		DNSNames:     []string{dnsName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	servingDER, err := x509.CreateCertificate(rand.Reader, servingTemplate, caCert, &servingKey.PublicKey, caKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	caCertPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: servingDER})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(servingKey)})
+	return caCertPEM, certPEM, keyPEM, nil
 }
 
 type serverImpl struct {
 	id        resource.ID
 	ns        namespace.Instance
 	providers []Provider
+
+	// caCertPEM, certPEM, and keyPEM are the TLS material generated for this server and
+	// applied as the certSecretName Secret. They're cached so DistributeCABundle can copy the
+	// exact same CA into caller namespaces, rather than generating a mismatched one.
+	caCertPEM, certPEM, keyPEM []byte
 }
 
 func (s *serverImpl) ID() resource.ID {
@@ -205,31 +532,93 @@ func (s *serverImpl) Providers() []Provider {
 func (s *serverImpl) templateArgs() map[string]interface{} {
 	fqdn := fmt.Sprintf("ext-authz.%s.svc.cluster.local", s.ns.Name())
 	return map[string]interface{}{
-		"fqdn":     fqdn,
-		"httpName": httpName,
-		"grpcName": grpcName,
-		"httpPort": httpPort,
-		"grpcPort": grpcPort,
+		"fqdn":           fqdn,
+		"namespace":      s.ns.Name(),
+		"httpName":       httpName,
+		"grpcName":       grpcName,
+		"httpsName":      httpsName,
+		"grpcsName":      grpcsName,
+		"httpPort":       httpPort,
+		"grpcPort":       grpcPort,
+		"httpsPort":      httpsPort,
+		"grpcsPort":      grpcsPort,
+		"opaName":        opaName,
+		"opaPort":        opaPort,
+		"certSecretName": certSecretName,
 	}
 }
 
 func installProviders(ctx resource.Context, providerYAML string) error {
-	var ist istio.Instance
+	// Now parse the provider YAML.
+	newMC := &meshconfig.MeshConfig{}
+	if err := protomarshal.ApplyYAML(providerYAML, newMC); err != nil {
+		return err
+	}
+
+	return updateMeshConfigProviders(ctx, func(mc *meshconfig.MeshConfig) error {
+		for _, p := range newMC.ExtensionProviders {
+			mc.ExtensionProviders = replaceOrAppendProvider(mc.ExtensionProviders, p)
+		}
+		return nil
+	})
+}
+
+// UpdateProvider mutates the named extension provider already registered in MeshConfig,
+// e.g. to toggle failOpen or change includeRequestHeadersInCheck without tearing down and
+// redeploying the whole authz server.
+func (s *serverImpl) UpdateProvider(ctx resource.Context, name string, mutate func(*meshconfig.MeshConfig_ExtensionProvider) error) error {
+	return updateMeshConfigProviders(ctx, func(mc *meshconfig.MeshConfig) error {
+		for _, p := range mc.ExtensionProviders {
+			if p.Name == name {
+				return mutate(p)
+			}
+		}
+		return fmt.Errorf("extension provider %q is not registered", name)
+	})
+}
+
+// RemoveProvider deregisters the named extension provider from MeshConfig.
+func (s *serverImpl) RemoveProvider(ctx resource.Context, name string) error {
+	return updateMeshConfigProviders(ctx, func(mc *meshconfig.MeshConfig) error {
+		mc.ExtensionProviders = removeProvider(mc.ExtensionProviders, name)
+		return nil
+	})
+}
+
+// updateMeshConfigProviders runs mutate against the current MeshConfig under the Istio
+// system namespace. Applying repeatedly is idempotent: mutate is responsible for merging
+// (rather than blindly appending) so that re-running newKubeServer, or tests that swap
+// provider config in place, don't accumulate stale entries.
+func updateMeshConfigProviders(ctx resource.Context, mutate func(*meshconfig.MeshConfig) error) error {
 	ist, err := istio.Get(ctx)
 	if err != nil {
 		return err
 	}
 
-	// Now parse the provider YAML.
-	newMC := &meshconfig.MeshConfig{}
-	if err := protomarshal.ApplyYAML(providerYAML, newMC); err != nil {
-		return err
+	return istio.UpdateMeshConfig(ctx, ist.Settings().SystemNamespace, ctx.Clusters(), mutate, cleanup.Conditionally)
+}
+
+// replaceOrAppendProvider returns providers with p replacing any existing entry of the same
+// name, or appended if no such entry exists.
+func replaceOrAppendProvider(
+	providers []*meshconfig.MeshConfig_ExtensionProvider,
+	p *meshconfig.MeshConfig_ExtensionProvider) []*meshconfig.MeshConfig_ExtensionProvider {
+	for i, existing := range providers {
+		if existing.Name == p.Name {
+			providers[i] = p
+			return providers
+		}
 	}
+	return append(providers, p)
+}
 
-	return istio.UpdateMeshConfig(ctx, ist.Settings().SystemNamespace, ctx.Clusters(),
-		func(mc *meshconfig.MeshConfig) error {
-			// Merge the extension providers.
-			mc.ExtensionProviders = append(mc.ExtensionProviders, newMC.ExtensionProviders...)
-			return nil
-		}, cleanup.Conditionally)
+// removeProvider returns providers with any entry named name removed.
+func removeProvider(providers []*meshconfig.MeshConfig_ExtensionProvider, name string) []*meshconfig.MeshConfig_ExtensionProvider {
+	out := providers[:0]
+	for _, p := range providers {
+		if p.Name != name {
+			out = append(out, p)
+		}
+	}
+	return out
 }
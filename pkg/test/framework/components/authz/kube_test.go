@@ -0,0 +1,137 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authz
+
+import (
+	"testing"
+
+	meshconfig "istio.io/api/mesh/v1alpha1"
+)
+
+func namedProvider(name string) *meshconfig.MeshConfig_ExtensionProvider {
+	return &meshconfig.MeshConfig_ExtensionProvider{Name: name}
+}
+
+func providerNames(providers []*meshconfig.MeshConfig_ExtensionProvider) []string {
+	names := make([]string, len(providers))
+	for i, p := range providers {
+		names[i] = p.Name
+	}
+	return names
+}
+
+func TestReplaceOrAppendProvider(t *testing.T) {
+	cases := []struct {
+		name      string
+		providers []*meshconfig.MeshConfig_ExtensionProvider
+		add       *meshconfig.MeshConfig_ExtensionProvider
+		want      []string
+	}{
+		{
+			name:      "append when not present",
+			providers: []*meshconfig.MeshConfig_ExtensionProvider{namedProvider("a")},
+			add:       namedProvider("b"),
+			want:      []string{"a", "b"},
+		},
+		{
+			name:      "replace existing entry in place",
+			providers: []*meshconfig.MeshConfig_ExtensionProvider{namedProvider("a"), namedProvider("b")},
+			add:       namedProvider("a"),
+			want:      []string{"a", "b"},
+		},
+		{
+			name:      "append to an empty list",
+			providers: nil,
+			add:       namedProvider("a"),
+			want:      []string{"a"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := providerNames(replaceOrAppendProvider(c.providers, c.add))
+			if len(got) != len(c.want) {
+				t.Fatalf("replaceOrAppendProvider() = %v, want %v", got, c.want)
+			}
+			for i := range got {
+				if got[i] != c.want[i] {
+					t.Errorf("replaceOrAppendProvider() = %v, want %v", got, c.want)
+				}
+			}
+		})
+	}
+
+	// The replaced entry's value, not just its name, must actually change.
+	existing := namedProvider("a")
+	replacement := &meshconfig.MeshConfig_ExtensionProvider{Name: "a", Provider: &meshconfig.MeshConfig_ExtensionProvider_EnvoyExtAuthzGrpc{}}
+	got := replaceOrAppendProvider([]*meshconfig.MeshConfig_ExtensionProvider{existing}, replacement)
+	if got[0] != replacement {
+		t.Errorf("replaceOrAppendProvider() did not replace the existing entry's value")
+	}
+}
+
+func TestRemoveProvider(t *testing.T) {
+	cases := []struct {
+		name      string
+		providers []*meshconfig.MeshConfig_ExtensionProvider
+		remove    string
+		want      []string
+	}{
+		{
+			name:      "remove the only entry",
+			providers: []*meshconfig.MeshConfig_ExtensionProvider{namedProvider("a")},
+			remove:    "a",
+			want:      []string{},
+		},
+		{
+			name:      "remove the last entry of several",
+			providers: []*meshconfig.MeshConfig_ExtensionProvider{namedProvider("a"), namedProvider("b")},
+			remove:    "b",
+			want:      []string{"a"},
+		},
+		{
+			name:      "remove the first entry of several",
+			providers: []*meshconfig.MeshConfig_ExtensionProvider{namedProvider("a"), namedProvider("b")},
+			remove:    "a",
+			want:      []string{"b"},
+		},
+		{
+			name:      "remove a name that isn't present",
+			providers: []*meshconfig.MeshConfig_ExtensionProvider{namedProvider("a")},
+			remove:    "missing",
+			want:      []string{"a"},
+		},
+		{
+			name:      "remove from an empty list",
+			providers: nil,
+			remove:    "a",
+			want:      []string{},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := providerNames(removeProvider(c.providers, c.remove))
+			if len(got) != len(c.want) {
+				t.Fatalf("removeProvider() = %v, want %v", got, c.want)
+			}
+			for i := range got {
+				if got[i] != c.want[i] {
+					t.Errorf("removeProvider() = %v, want %v", got, c.want)
+				}
+			}
+		})
+	}
+}
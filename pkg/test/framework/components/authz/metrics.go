@@ -0,0 +1,185 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authz
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"istio.io/istio/pkg/test/framework/components/namespace"
+	"istio.io/istio/pkg/test/framework/resource"
+	"istio.io/istio/pkg/test/kube"
+)
+
+// Metrics holds the ext-authz sample's Check counters for one provider's protocol family,
+// scraped from its Prometheus /metrics endpoint. The counters are not split per provider:
+// HTTP and HTTPS providers read the same metrics, as do GRPC, GRPCS and OPA providers.
+type Metrics struct {
+	// ChecksTotal is the number of Check RPCs/requests the server received.
+	ChecksTotal int
+	// Allows is the number of Check calls the server allowed.
+	Allows int
+	// Denies is the number of Check calls the server denied.
+	Denies int
+	// LatencyBucketsMs maps each histogram bucket's upper bound (in milliseconds) to its
+	// cumulative count, mirroring a Prometheus histogram's `le` buckets.
+	LatencyBucketsMs map[float64]int
+}
+
+// scrapeMetrics port-forwards to the ext-authz pod's metrics port, scrapes its Prometheus
+// exposition, and returns the counters for the given provider API. The gRPC provider's
+// counters come from grpc-ecosystem/go-grpc-prometheus server metrics; the HTTP provider's
+// from the standard net/http handler metrics the sample registers alongside it.
+func scrapeMetrics(ctx resource.Context, ns namespace.Instance, api API) (Metrics, error) {
+	m := Metrics{LatencyBucketsMs: map[float64]int{}}
+
+	clusters := ctx.Clusters()
+	if len(clusters) == 0 {
+		return m, fmt.Errorf("no clusters available to scrape ext-authz metrics")
+	}
+	c := clusters[0]
+
+	pods, err := c.Kube().CoreV1().Pods(ns.Name()).List(context.TODO(), metav1.ListOptions{LabelSelector: "app=ext-authz"})
+	if err != nil {
+		return m, err
+	}
+	if len(pods.Items) == 0 {
+		return m, fmt.Errorf("no ext-authz pods found in namespace %s", ns.Name())
+	}
+	pod := pods.Items[0]
+
+	fw, err := kube.NewPortForwarder(c, pod.Namespace, pod.Name, 0, metricsPort)
+	if err != nil {
+		return m, err
+	}
+	if err := fw.Start(); err != nil {
+		return m, err
+	}
+	defer fw.Close()
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/metrics", fw.Address()))
+	if err != nil {
+		return m, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return m, err
+	}
+
+	if err := parseExposition(string(body), api, &m); err != nil {
+		return m, fmt.Errorf("scraping %s metrics: %v", api, err)
+	}
+	return m, nil
+}
+
+// parseExposition does a minimal parse of the subset of the Prometheus text exposition
+// format the ext-authz sample emits: `metric{labels} value` lines, with no multi-line
+// HELP/TYPE handling beyond skipping comment lines.
+//
+// It returns an error if the check/allow/deny metrics it's looking for never appear at all,
+// rather than silently leaving m's counters at zero. Today that error always fires: the
+// ext-authz sample in this tree hasn't been updated to register
+// grpc-ecosystem/go-grpc-prometheus server metrics (for the gRPC provider) or standard
+// net/http handler metrics (for the HTTP provider), so metricNamesFor's names match nothing
+// the sample actually exposes. TODO(ext-authz sample): land that instrumentation, then this
+// can go back to treating a metric's absence before a Check call as legitimately zero.
+func parseExposition(text string, api API, m *Metrics) error {
+	checkMetric, allowMetric, denyMetric, latencyMetric := metricNamesFor(api)
+	var sawCheck, sawAllow, sawDeny bool
+
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, labels, value := splitExpositionLine(line)
+		if method, ok := labels["grpc_method"]; ok && method != "Check" {
+			continue
+		}
+		switch {
+		case name == checkMetric:
+			m.ChecksTotal += int(value)
+			sawCheck = true
+		case name == allowMetric:
+			m.Allows += int(value)
+			sawAllow = true
+		case name == denyMetric:
+			m.Denies += int(value)
+			sawDeny = true
+		case name == latencyMetric:
+			if le, ok := labels["le"]; ok {
+				if bound, err := strconv.ParseFloat(le, 64); err == nil {
+					if strings.HasSuffix(latencyMetric, "_seconds_bucket") {
+						bound *= 1000
+					}
+					m.LatencyBucketsMs[bound] = int(value)
+				}
+			}
+		}
+	}
+
+	if !sawCheck && !sawAllow && !sawDeny {
+		return fmt.Errorf("none of %q, %q, %q were present in the scraped exposition; "+
+			"either the ext-authz sample doesn't expose them yet or metricNamesFor is wrong -- "+
+			"treating this as a hard failure instead of silently reporting all-zero counts",
+			checkMetric, allowMetric, denyMetric)
+	}
+	return nil
+}
+
+func metricNamesFor(api API) (checkMetric, allowMetric, denyMetric, latencyMetric string) {
+	if api == HTTP || api == HTTPS {
+		return "ext_authz_http_checks_total", "ext_authz_http_allows_total", "ext_authz_http_denies_total", "ext_authz_http_check_duration_ms_bucket"
+	}
+	return "grpc_server_handled_total", "ext_authz_grpc_allows_total", "ext_authz_grpc_denies_total", "grpc_server_handling_seconds_bucket"
+}
+
+// splitExpositionLine splits a single exposition line of the form
+// `metric_name{label="value",...} 1.0` into its name, labels, and float value.
+func splitExpositionLine(line string) (name string, labels map[string]string, value float64) {
+	labels = map[string]string{}
+
+	spaceIdx := strings.LastIndex(line, " ")
+	if spaceIdx < 0 {
+		return "", labels, 0
+	}
+	value, _ = strconv.ParseFloat(line[spaceIdx+1:], 64)
+
+	head := line[:spaceIdx]
+	braceIdx := strings.IndexByte(head, '{')
+	if braceIdx < 0 {
+		return head, labels, value
+	}
+	name = head[:braceIdx]
+
+	labelStr := strings.TrimSuffix(head[braceIdx+1:], "}")
+	for _, kv := range strings.Split(labelStr, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		labels[parts[0]] = strings.Trim(parts[1], `"`)
+	}
+	return name, labels, value
+}
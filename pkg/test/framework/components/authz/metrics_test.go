@@ -0,0 +1,103 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authz
+
+import "testing"
+
+const testHTTPExposition = `
+# HELP ext_authz_http_checks_total total Check calls
+# TYPE ext_authz_http_checks_total counter
+ext_authz_http_checks_total 3
+ext_authz_http_allows_total 2
+ext_authz_http_denies_total 1
+ext_authz_http_check_duration_ms_bucket{le="10"} 2
+ext_authz_http_check_duration_ms_bucket{le="50"} 3
+`
+
+func TestParseExposition(t *testing.T) {
+	m := Metrics{LatencyBucketsMs: map[float64]int{}}
+	if err := parseExposition(testHTTPExposition, HTTP, &m); err != nil {
+		t.Fatalf("parseExposition: %v", err)
+	}
+
+	if m.ChecksTotal != 3 {
+		t.Errorf("ChecksTotal = %d, want 3", m.ChecksTotal)
+	}
+	if m.Allows != 2 {
+		t.Errorf("Allows = %d, want 2", m.Allows)
+	}
+	if m.Denies != 1 {
+		t.Errorf("Denies = %d, want 1", m.Denies)
+	}
+	if want := map[float64]int{10: 2, 50: 3}; m.LatencyBucketsMs[10] != want[10] || m.LatencyBucketsMs[50] != want[50] {
+		t.Errorf("LatencyBucketsMs = %v, want %v", m.LatencyBucketsMs, want)
+	}
+}
+
+func TestParseExpositionNoMatchingMetrics(t *testing.T) {
+	m := Metrics{LatencyBucketsMs: map[float64]int{}}
+	err := parseExposition("go_gc_duration_seconds 0.1\n", HTTP, &m)
+	if err == nil {
+		t.Fatal("parseExposition: expected an error when none of the expected metrics are present, got nil")
+	}
+}
+
+func TestSplitExpositionLine(t *testing.T) {
+	cases := []struct {
+		name       string
+		line       string
+		wantName   string
+		wantLabels map[string]string
+		wantValue  float64
+	}{
+		{
+			name:      "no labels",
+			line:      "ext_authz_http_checks_total 3",
+			wantName:  "ext_authz_http_checks_total",
+			wantValue: 3,
+		},
+		{
+			name:       "single label",
+			line:       `ext_authz_http_check_duration_ms_bucket{le="10"} 2`,
+			wantName:   "ext_authz_http_check_duration_ms_bucket",
+			wantLabels: map[string]string{"le": "10"},
+			wantValue:  2,
+		},
+		{
+			name:       "multiple labels",
+			line:       `grpc_server_handled_total{grpc_method="Check",grpc_code="OK"} 5`,
+			wantName:   "grpc_server_handled_total",
+			wantLabels: map[string]string{"grpc_method": "Check", "grpc_code": "OK"},
+			wantValue:  5,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			name, labels, value := splitExpositionLine(c.line)
+			if name != c.wantName {
+				t.Errorf("name = %q, want %q", name, c.wantName)
+			}
+			if value != c.wantValue {
+				t.Errorf("value = %v, want %v", value, c.wantValue)
+			}
+			for k, want := range c.wantLabels {
+				if got := labels[k]; got != want {
+					t.Errorf("labels[%q] = %q, want %q", k, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authz
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"istio.io/istio/pkg/test/framework/components/authz/rbac"
+	"istio.io/istio/pkg/test/framework/components/namespace"
+	"istio.io/istio/pkg/test/framework/resource"
+	"istio.io/istio/pkg/test/framework/resource/config/apply"
+	"istio.io/istio/pkg/test/util/tmpl"
+)
+
+// defaultOPAPolicy denies everything until a test pushes its own policy via Provider.WithPolicy.
+const defaultOPAPolicy = `{"name": "default-deny", "allow_rules": [], "deny_rules": []}`
+
+// updateOPAPolicy rewrites the ConfigMap that the OPA-backed ext-authz sample watches, so the
+// pod hot-reloads the new policy document without a redeploy.
+func updateOPAPolicy(ctx resource.Context, ns namespace.Instance, policyJSON string) error {
+	if _, err := rbac.ParsePolicy(policyJSON); err != nil {
+		return err
+	}
+
+	cmYAML, err := tmpl.Evaluate(opaPolicyConfigMapTemplate, map[string]interface{}{
+		"configMapName": opaPolicyConfigMap,
+		"configMapKey":  opaPolicyConfigKey,
+		"namespace":     ns.Name(),
+		"policy":        indentYAMLBlock(policyJSON, 4),
+	})
+	if err != nil {
+		return err
+	}
+
+	return ctx.ConfigKube(ctx.Clusters()...).
+		YAML(ns.Name(), cmYAML).
+		Apply(apply.CleanupConditionally)
+}
+
+// currentOPATranslator reads the ConfigMap the OPA-backed ext-authz sample currently watches
+// and returns a Translator for it, so checkOPA can compute the decision the sample is expected
+// to reach for a given request without trusting that the sample's own reload logic is correct.
+func currentOPATranslator(ctx resource.Context, ns namespace.Instance) (*rbac.Translator, error) {
+	clusters := ctx.Clusters()
+	if len(clusters) == 0 {
+		return nil, fmt.Errorf("no clusters available to read the OPA policy ConfigMap")
+	}
+
+	cm, err := clusters[0].Kube().CoreV1().ConfigMaps(ns.Name()).Get(context.TODO(), opaPolicyConfigMap, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	policyJSON, ok := cm.Data[opaPolicyConfigKey]
+	if !ok {
+		return nil, fmt.Errorf("ConfigMap %s/%s has no %q key", ns.Name(), opaPolicyConfigMap, opaPolicyConfigKey)
+	}
+
+	return rbac.NewTranslator(policyJSON)
+}
+
+// indentYAMLBlock indents every line of s by the given number of spaces, for embedding
+// multi-line text under a YAML block scalar ("|").
+func indentYAMLBlock(s string, spaces int) string {
+	pad := strings.Repeat(" ", spaces)
+	lines := strings.Split(s, "\n")
+	for i, l := range lines {
+		lines[i] = pad + l
+	}
+	return strings.Join(lines, "\n")
+}
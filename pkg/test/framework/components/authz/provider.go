@@ -0,0 +1,176 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authz
+
+import (
+	"fmt"
+	"strings"
+
+	"istio.io/istio/pkg/config/protocol"
+	"istio.io/istio/pkg/test/framework/components/authz/rbac"
+	"istio.io/istio/pkg/test/framework/components/echo"
+	"istio.io/istio/pkg/test/framework/components/namespace"
+	"istio.io/istio/pkg/test/framework/resource"
+)
+
+// API identifies the wire protocol/variant of an ext-authz provider (e.g. plaintext HTTP,
+// plaintext gRPC, their TLS-secured counterparts, or the OPA-backed policy provider).
+type API string
+
+const (
+	// HTTP is the API value for the plaintext HTTP ext-authz provider.
+	HTTP API = "http"
+	// GRPC is the API value for the plaintext gRPC ext-authz provider.
+	GRPC API = "grpc"
+)
+
+// Provider is a configured ext-authz extension provider backed by the deployed ext-authz
+// sample, along with the means to verify that a policy referencing it behaves as expected.
+type Provider interface {
+	// Name returns the MeshConfig extension provider name.
+	Name() string
+
+	// API returns the wire protocol/variant this provider implements.
+	API() API
+
+	// WithPolicy pushes a new RBAC-style JSON policy document to this provider, for providers
+	// backed by a policy engine that supports runtime reconfiguration. Providers that don't
+	// support this return an error.
+	WithPolicy(ctx resource.Context, policyJSON string) error
+
+	// Metrics scrapes the ext-authz sample's Prometheus endpoint and returns the counters
+	// recorded for this provider's protocol family (see Metrics), so tests can assert the
+	// server actually handled the expected number of Check calls.
+	Metrics(ctx resource.Context) (Metrics, error)
+
+	// Check asserts that a call made through the given options was allowed/denied as expected
+	// by this provider.
+	Check(ctx resource.Context, from echo.Caller, opts echo.CallOptions, allow bool) error
+}
+
+// checkFunc asserts that a call made through the given options was allowed/denied as expected.
+type checkFunc func(ctx resource.Context, from echo.Caller, opts echo.CallOptions, allow bool) error
+
+var _ Provider = &providerImpl{}
+
+type providerImpl struct {
+	name string
+	api  API
+
+	// protocolSupported reports whether this provider can be exercised for the given traffic
+	// protocol (e.g. the HTTP provider cannot authorize raw TCP traffic).
+	protocolSupported func(protocol.Instance) bool
+
+	// targetSupported reports whether this provider can be exercised against the given target.
+	targetSupported func(echo.Target) bool
+
+	// check verifies that a call was allowed/denied as expected by this provider.
+	check checkFunc
+
+	// ns is set for providers that need to reach into the deployment's namespace at runtime,
+	// e.g. the OPA-backed provider pushing a new policy document.
+	ns namespace.Instance
+
+	// externalEndpoint is set for providers backed by an ExternalEndpoint (see external.go),
+	// so check can call the external authorizer directly rather than only inferring its
+	// decision from headers the ext-authz sample would have added.
+	externalEndpoint *ExternalEndpoint
+}
+
+func (p *providerImpl) Name() string {
+	return p.name
+}
+
+func (p *providerImpl) API() API {
+	return p.api
+}
+
+func (p *providerImpl) Metrics(ctx resource.Context) (Metrics, error) {
+	return scrapeMetrics(ctx, p.ns, p.api)
+}
+
+func (p *providerImpl) WithPolicy(ctx resource.Context, policyJSON string) error {
+	if p.api != OPA {
+		return fmt.Errorf("provider %s does not support runtime policy updates", p.name)
+	}
+	return updateOPAPolicy(ctx, p.ns, policyJSON)
+}
+
+func (p *providerImpl) Check(ctx resource.Context, from echo.Caller, opts echo.CallOptions, allow bool) error {
+	switch {
+	case p.api == OPA:
+		return checkOPA(ctx, p.ns, from, opts, allow)
+	case p.api == HTTP && p.externalEndpoint != nil:
+		return checkExternalHTTP(*p.externalEndpoint, from, opts, allow)
+	default:
+		return p.check(ctx, from, opts, allow)
+	}
+}
+
+func checkHTTP(ctx resource.Context, from echo.Caller, opts echo.CallOptions, allow bool) error {
+	return checkAllow(from, opts, allow)
+}
+
+func checkGRPC(ctx resource.Context, from echo.Caller, opts echo.CallOptions, allow bool) error {
+	return checkAllow(from, opts, allow)
+}
+
+func checkAllow(from echo.Caller, opts echo.CallOptions, allow bool) error {
+	_, err := from.Call(opts)
+	if allow && err != nil {
+		return fmt.Errorf("expected call to be allowed, but it was denied: %v", err)
+	}
+	if !allow && err == nil {
+		return fmt.Errorf("expected call to be denied, but it was allowed")
+	}
+	return nil
+}
+
+// checkOPA verifies not just that the call was allowed/denied as expected, but that the
+// decision agrees with what the OPA-backed sample's currently pushed RBAC policy computes
+// locally via rbac.Translator -- catching cases where the server's decision happens to match
+// the test's expectation for the wrong reason (e.g. it ignored the pushed policy entirely).
+func checkOPA(ctx resource.Context, ns namespace.Instance, from echo.Caller, opts echo.CallOptions, allow bool) error {
+	translator, err := currentOPATranslator(ctx, ns)
+	if err != nil {
+		return fmt.Errorf("failed reading the OPA policy to verify the decision locally: %v", err)
+	}
+
+	req := requestFromCallOptions(opts)
+	if got := translator.Allow(req); got != allow {
+		return fmt.Errorf("test policy mismatch: translator computed allow=%v for %+v, but the test expected allow=%v", got, req, allow)
+	}
+
+	return checkAllow(from, opts, allow)
+}
+
+// requestFromCallOptions extracts the fields the RBAC policy matches against from the outgoing
+// call, mirroring how the OPA-backed ext-authz sample is expected to read them off the
+// incoming CheckRequest: the path from the HTTP request line, and the caller's principal from
+// the x-ext-authz-principal header tests set to drive policy matching.
+func requestFromCallOptions(opts echo.CallOptions) rbac.Request {
+	headers := map[string]string{}
+	for k, v := range opts.HTTP.Headers {
+		if len(v) > 0 {
+			headers[strings.ToLower(k)] = v[0]
+		}
+	}
+
+	return rbac.Request{
+		Principal: opts.HTTP.Headers.Get("x-ext-authz-principal"),
+		Path:      opts.HTTP.Path,
+		Headers:   headers,
+	}
+}
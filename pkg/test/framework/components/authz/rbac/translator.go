@@ -0,0 +1,143 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package rbac implements a tiny, static, RBAC-style authorization translator that mirrors
+// the ext-authz decision an OPA-backed provider would make. It lets authz integration tests
+// compute the expected Check outcome locally, from the same JSON policy document pushed to
+// the deployed ext-authz sample, instead of hard-coding header-based expectations.
+package rbac
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Request is the subset of an ext-authz CheckRequest that the translator evaluates.
+type Request struct {
+	// Principal identifies the caller, e.g. the source's SPIFFE identity.
+	Principal string
+	// Path is the request path being authorized.
+	Path string
+	// Headers holds the request headers relevant to the policy.
+	Headers map[string]string
+}
+
+// Source matches the request's principal against a list of allowed principals.
+type Source struct {
+	Principals []string `json:"principals"`
+}
+
+// Match matches the request's path and headers.
+type Match struct {
+	Paths   []string          `json:"paths"`
+	Headers map[string]string `json:"headers"`
+}
+
+// Rule is a single allow/deny rule: the request matches the rule when both Source and Request
+// match (an empty Source or Request matches everything).
+type Rule struct {
+	Source  Source `json:"source"`
+	Request Match  `json:"request"`
+}
+
+// Policy is the JSON document a test supplies to configure the OPA-backed provider.
+type Policy struct {
+	Name       string `json:"name"`
+	AllowRules []Rule `json:"allow_rules"`
+	DenyRules  []Rule `json:"deny_rules"`
+}
+
+// ParsePolicy parses a JSON-encoded Policy document.
+func ParsePolicy(policyJSON string) (*Policy, error) {
+	p := &Policy{}
+	if err := json.Unmarshal([]byte(policyJSON), p); err != nil {
+		return nil, fmt.Errorf("failed parsing rbac policy: %v", err)
+	}
+	return p, nil
+}
+
+// Translator evaluates Requests against a Policy, mirroring the semantics of grpc-go's static
+// authorization translator: deny_rules are evaluated first (deny if any match), then
+// allow_rules (allow if any match), and the request is denied if neither matches.
+type Translator struct {
+	policy *Policy
+}
+
+// NewTranslator creates a Translator for the given JSON policy document.
+func NewTranslator(policyJSON string) (*Translator, error) {
+	p, err := ParsePolicy(policyJSON)
+	if err != nil {
+		return nil, err
+	}
+	return &Translator{policy: p}, nil
+}
+
+// Allow returns whether the Policy allows the given Request.
+func (t *Translator) Allow(req Request) bool {
+	for _, r := range t.policy.DenyRules {
+		if ruleMatches(r, req) {
+			return false
+		}
+	}
+	for _, r := range t.policy.AllowRules {
+		if ruleMatches(r, req) {
+			return true
+		}
+	}
+	return false
+}
+
+func ruleMatches(r Rule, req Request) bool {
+	if !matchesAny(r.Source.Principals, req.Principal) {
+		return false
+	}
+	if !matchesAny(r.Request.Paths, req.Path) {
+		return false
+	}
+	for k, pattern := range r.Request.Headers {
+		if !matchString(pattern, req.Headers[k]) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesAny returns true if patterns is empty (matches everything) or any pattern matches v.
+func matchesAny(patterns []string, v string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if matchString(p, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchString matches v against pattern, supporting exact match, "*" (matches anything),
+// prefix match ("foo*"), and suffix match ("*foo").
+func matchString(pattern, v string) bool {
+	switch {
+	case pattern == "*":
+		return true
+	case strings.HasSuffix(pattern, "*"):
+		return strings.HasPrefix(v, strings.TrimSuffix(pattern, "*"))
+	case strings.HasPrefix(pattern, "*"):
+		return strings.HasSuffix(v, strings.TrimPrefix(pattern, "*"))
+	default:
+		return pattern == v
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import "testing"
+
+const testPolicy = `{
+  "name": "test-policy",
+  "allow_rules": [
+    {
+      "source": {"principals": ["cluster.local/ns/default/sa/a"]},
+      "request": {"paths": ["/public*"]}
+    },
+    {
+      "source": {"principals": ["*"]},
+      "request": {"paths": ["/admin"], "headers": {"x-admin-token": "secret"}}
+    }
+  ],
+  "deny_rules": [
+    {
+      "source": {"principals": ["*"]},
+      "request": {"paths": ["*/internal"]}
+    }
+  ]
+}`
+
+func TestTranslatorAllow(t *testing.T) {
+	tr, err := NewTranslator(testPolicy)
+	if err != nil {
+		t.Fatalf("NewTranslator: %v", err)
+	}
+
+	cases := []struct {
+		name string
+		req  Request
+		want bool
+	}{
+		{
+			name: "allowed by principal and path prefix",
+			req:  Request{Principal: "cluster.local/ns/default/sa/a", Path: "/public/resource"},
+			want: true,
+		},
+		{
+			name: "allowed by wildcard principal with matching header",
+			req:  Request{Principal: "cluster.local/ns/default/sa/b", Path: "/admin", Headers: map[string]string{"x-admin-token": "secret"}},
+			want: true,
+		},
+		{
+			name: "denied by wrong header value",
+			req:  Request{Principal: "cluster.local/ns/default/sa/b", Path: "/admin", Headers: map[string]string{"x-admin-token": "wrong"}},
+			want: false,
+		},
+		{
+			name: "denied by deny rule overriding a matching allow rule",
+			req:  Request{Principal: "cluster.local/ns/default/sa/a", Path: "/public/internal"},
+			want: false,
+		},
+		{
+			name: "denied by default when nothing matches",
+			req:  Request{Principal: "cluster.local/ns/default/sa/c", Path: "/other"},
+			want: false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := tr.Allow(c.req); got != c.want {
+				t.Errorf("Allow(%+v) = %v, want %v", c.req, got, c.want)
+			}
+		})
+	}
+}
+
+func TestMatchString(t *testing.T) {
+	cases := []struct {
+		pattern, value string
+		want           bool
+	}{
+		{"*", "anything", true},
+		{"foo*", "foobar", true},
+		{"foo*", "barfoo", false},
+		{"*foo", "barfoo", true},
+		{"*foo", "foobar", false},
+		{"exact", "exact", true},
+		{"exact", "other", false},
+	}
+	for _, c := range cases {
+		if got := matchString(c.pattern, c.value); got != c.want {
+			t.Errorf("matchString(%q, %q) = %v, want %v", c.pattern, c.value, got, c.want)
+		}
+	}
+}